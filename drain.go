@@ -1,11 +1,14 @@
 package drain
 
 import (
+	"encoding/gob"
 	"fmt"
+	"io"
 	"math"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/hashicorp/golang-lru/simplelru"
@@ -18,14 +21,134 @@ type Config struct {
 	MaxChildren     int
 	ExtraDelimiters []string
 	MaxClusters     int
-	ParamPatterns   map[string]*regexp.Regexp
-	Tokenizer       func(string) []string
+	// Version is written into the header of every Snapshot and checked by
+	// LoadSnapshot, so snapshots taken under an incompatible schema are
+	// rejected rather than silently loaded.
+	Version       int
+	ParamPatterns map[string]*regexp.Regexp
+	// Tokenizer is kept for back-compat with callers constructing Config
+	// directly. It is wrapped into LineTokenizer by New when LineTokenizer
+	// is left unset.
+	Tokenizer     func(string) []string
+	LineTokenizer LineTokenizer
+	// MinTokens is the minimum number of tokens a line must produce after
+	// tokenization for Train to consider it. Lines with fewer tokens are
+	// ignored (Train returns nil) instead of polluting the tree with
+	// degenerate 1-2 token clusters. Zero disables the guard.
+	MinTokens int
+	// PreProcessors run in order on the raw content before tokenization,
+	// e.g. to mask timestamps, UUIDs, request IDs, or ANSI escapes.
+	// Pre-processors run first, then tokenization, then param matching
+	// per token via ParamPatterns.
+	PreProcessors []func(string) string
+	// OnEvict, if set, is called whenever a cluster is removed from the
+	// cluster cache, whether because the LRU evicted it (MaxClusters was
+	// exceeded) or because Prune removed it. Its leaf clusterIDs entry in
+	// the prefix tree is cleaned up lazily the next time addSeqToPrefixTree
+	// visits that leaf, except when Prune triggered the removal, which
+	// rewrites affected leaves eagerly.
+	OnEvict func(*Cluster)
+	// Metrics, if set, receives a TrainStats report after every Train or
+	// TrainTokens call; lines rejected by MinTokens are not reported. Callers can bridge tree-branching behavior to Prometheus and tune
+	// SimTh, MaxChildren, and ClusterDepth empirically.
+	Metrics Metrics
+	// Joiner renders the tokens passed to TrainTokens back into a display
+	// string for Cluster.String(), since those clusters bypass
+	// LineTokenizer entirely. Defaults to strings.Join(t, " ").
+	Joiner func([]string) string
+}
+
+// Metrics receives per-Train call statistics.
+type Metrics interface {
+	ObserveTrain(TrainStats)
+}
+
+// TrainStats reports what happened to the prefix tree during a single
+// Train call.
+type TrainStats struct {
+	// TokensSeen is the number of tokens the line produced.
+	TokensSeen int
+	// TreeDepth is the depth reached in the prefix tree.
+	TreeDepth int
+	// NewCluster is true if Train created a new cluster rather than
+	// matching an existing one.
+	NewCluster bool
+	// WildcardBranch is true if addSeqToPrefixTree took an existing
+	// wildcard branch, or created one in the last free child slot, instead
+	// of creating a token-specific one, because MaxChildren was saturated.
+	WildcardBranch bool
+	// StaleClusterPruned is true if addSeqToPrefixTree dropped one or more
+	// stale cluster IDs from a leaf node while inserting this cluster.
+	StaleClusterPruned bool
+}
+
+// LineTokenizer splits a raw log line into tokens and reconstructs a
+// printable line (or template) from tokens. Implementations are expected to
+// be the inverse of each other for lines that round-trip cleanly, though
+// Join need not perfectly reproduce the original separators.
+type LineTokenizer interface {
+	Tokenize(string) []string
+	Join([]string) string
+}
+
+// funcLineTokenizer adapts a legacy Config.Tokenizer func into a
+// LineTokenizer, joining tokens back together with single spaces.
+type funcLineTokenizer struct {
+	tokenize func(string) []string
+}
+
+func (t funcLineTokenizer) Tokenize(content string) []string {
+	return t.tokenize(content)
+}
+
+func (t funcLineTokenizer) Join(tokens []string) string {
+	return strings.Join(tokens, " ")
+}
+
+// punctuationSplitter matches runs of whitespace and most ASCII punctuation.
+// Characters that commonly appear inside tokens worth keeping intact - '.',
+// '-', '_', '+', '%', '#', '@', '!', '?', '*', '&', '^', '~', '`', '$' - are
+// deliberately excluded so that IPs, hex numbers, and dotted identifiers
+// survive tokenization.
+var punctuationSplitter = regexp.MustCompile(`[\s,;:=()\[\]{}"'<>|/\\]+`)
+
+// PunctuationTokenizer splits on runs of punctuation and whitespace instead
+// of whitespace alone, so structured lines (JSON-ish, k=v pairs, bracketed
+// prefixes) don't collapse into a single blob the way SpaceTokenizer would.
+type PunctuationTokenizer struct{}
+
+func (PunctuationTokenizer) Tokenize(content string) []string {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return []string{""}
+	}
+	tokens := punctuationSplitter.Split(content, -1)
+	result := tokens[:0]
+	for _, token := range tokens {
+		if token != "" {
+			result = append(result, token)
+		}
+	}
+	if len(result) == 0 {
+		return []string{""}
+	}
+	return result
+}
+
+func (PunctuationTokenizer) Join(tokens []string) string {
+	return strings.Join(tokens, " ")
 }
 
 type Cluster struct {
 	tokens []string
 	id     int
 	size   int
+	join   func([]string) string
+	// fromTokens is true if this cluster was created via TrainTokens, so
+	// LoadSnapshot knows to restore join from Config.Joiner rather than
+	// Config.LineTokenizer.Join.
+	fromTokens bool
+	lastSeen   time.Time
 }
 
 // Tokens returns the tokens of the Cluster.
@@ -36,14 +159,24 @@ func (c *Cluster) Tokens() []string {
 	return c.tokens
 }
 func (c *Cluster) String() string {
-	return fmt.Sprintf("id={%d} : size={%d} : %s", c.id, c.size, strings.Join(c.tokens, " "))
+	join := c.join
+	if join == nil {
+		join = func(tokens []string) string { return strings.Join(tokens, " ") }
+	}
+	return fmt.Sprintf("id={%d} : size={%d} : %s", c.id, c.size, join(c.tokens))
 }
 
-func createClusterCache(maxSize int) *ClusterCache {
+func createClusterCache(maxSize int, onEvict func(*Cluster)) *ClusterCache {
 	if maxSize == 0 {
 		maxSize = math.MaxInt
 	}
-	cache, _ := simplelru.NewLRU(maxSize, nil)
+	var evictCallback simplelru.EvictCallback
+	if onEvict != nil {
+		evictCallback = func(_ interface{}, value interface{}) {
+			onEvict(value.(*Cluster))
+		}
+	}
+	cache, _ := simplelru.NewLRU(maxSize, evictCallback)
 	return &ClusterCache{
 		cache: cache,
 	}
@@ -75,6 +208,10 @@ func (c *ClusterCache) Get(key int) *Cluster {
 	return cluster.(*Cluster)
 }
 
+func (c *ClusterCache) Remove(key int) {
+	c.cache.Remove(key)
+}
+
 func createNode() *Node {
 	return &Node{
 		keyToChildNode: make(map[string]*Node),
@@ -91,7 +228,8 @@ func DefaultConfig() *Config {
 	return &Config{
 		ClusterDepth: 4,
 		SimTh:        0.4,
-		MaxChildren:  100,
+		MaxChildren:  15,
+		MinTokens:    4,
 		ParamPatterns: map[string]*regexp.Regexp{
 			"*": regexp.MustCompile(`.*`),
 		},
@@ -127,11 +265,21 @@ func New(config *Config) *Drain {
 		panic("depth argument must be at least 3")
 	}
 	config.maxNodeDepth = config.ClusterDepth - 2
+	if config.LineTokenizer == nil {
+		tokenizer := config.Tokenizer
+		if tokenizer == nil {
+			tokenizer = SpaceTokenizer
+		}
+		config.LineTokenizer = funcLineTokenizer{tokenize: tokenizer}
+	}
+	if config.Joiner == nil {
+		config.Joiner = func(tokens []string) string { return strings.Join(tokens, " ") }
+	}
 
 	d := &Drain{
 		config:      config,
 		rootNode:    createNode(),
-		idToCluster: createClusterCache(config.MaxClusters),
+		idToCluster: createClusterCache(config.MaxClusters, config.OnEvict),
 	}
 	return d
 }
@@ -156,37 +304,116 @@ func (d *Drain) Clusters() []*Cluster {
 // The content parameter is a string representing the content to be trained.
 // The function returns a pointer to a Cluster.
 func (d *Drain) Train(content string) *Cluster {
-	contentTokens := d.config.Tokenizer(content)
+	for _, preProcessor := range d.config.PreProcessors {
+		content = preProcessor(content)
+	}
+
+	contentTokens := d.config.LineTokenizer.Tokenize(content)
+	return d.trainTokens(contentTokens, d.config.LineTokenizer.Join, false)
+}
+
+// TrainTokens trains the Drain model with pre-tokenized input, bypassing
+// Config.LineTokenizer entirely. It is useful for callers that already
+// tokenize upstream (e.g. structured log pipelines with their own grammar),
+// or that replay the same tokens across multiple Drain instances with
+// different SimTh values.
+//
+// Cluster.String() renders clusters produced this way via Config.Joiner.
+func (d *Drain) TrainTokens(tokens []string) *Cluster {
+	return d.trainTokens(tokens, d.config.Joiner, true)
+}
 
-	matchCluster := d.treeSearch(d.rootNode, contentTokens, d.config.SimTh, false)
+func (d *Drain) trainTokens(contentTokens []string, join func([]string) string, fromTokens bool) *Cluster {
+	if len(contentTokens) < d.config.MinTokens {
+		return nil
+	}
+
+	matchCluster, depth := d.treeSearch(d.rootNode, contentTokens, d.config.SimTh, false)
+	stats := TrainStats{TokensSeen: len(contentTokens), TreeDepth: depth}
 	// Match no existing cluster
 	if matchCluster == nil {
 		d.clustersCounter++
 		clusterID := d.clustersCounter
 		matchCluster = &Cluster{
-			tokens: contentTokens,
-			id:     clusterID,
-			size:   1,
+			tokens:     contentTokens,
+			id:         clusterID,
+			size:       1,
+			join:       join,
+			fromTokens: fromTokens,
+			lastSeen:   time.Now(),
 		}
 		d.idToCluster.Set(clusterID, matchCluster)
-		d.addSeqToPrefixTree(d.rootNode, matchCluster)
+		stats.NewCluster = true
+		stats.TreeDepth, stats.WildcardBranch, stats.StaleClusterPruned = d.addSeqToPrefixTree(d.rootNode, matchCluster)
 	} else {
 		newTemplateTokens := d.createTemplate(contentTokens, matchCluster.tokens)
 		matchCluster.tokens = newTemplateTokens
 		matchCluster.size++
+		matchCluster.lastSeen = time.Now()
 		// Touch cluster to update its state in the cache.
 		d.idToCluster.Get(matchCluster.id)
 	}
+	if d.config.Metrics != nil {
+		d.config.Metrics.ObserveTrain(stats)
+	}
 	return matchCluster
 }
 
 // Match against an already existing cluster. Match shall be perfect (sim_th=1.0). New cluster will not be created as a result of this call, nor any cluster modifications.
 func (d *Drain) Match(content string) *Cluster {
-	contentTokens := d.config.Tokenizer(content)
-	matchCluster := d.treeSearch(d.rootNode, contentTokens, 1.0, true)
+	contentTokens := d.config.LineTokenizer.Tokenize(content)
+	matchCluster, _ := d.treeSearch(d.rootNode, contentTokens, 1.0, true)
+	return matchCluster
+}
+
+// MatchTokens matches pre-tokenized input against an already existing
+// cluster, bypassing Config.LineTokenizer. See TrainTokens for why a caller
+// would supply tokens directly. Match semantics are unchanged: the match
+// must be perfect (sim_th=1.0) and no cluster is created or modified.
+func (d *Drain) MatchTokens(tokens []string) *Cluster {
+	matchCluster, _ := d.treeSearch(d.rootNode, tokens, 1.0, true)
 	return matchCluster
 }
 
+// Prune removes clusters whose size is below minSize, or whose lastSeen is
+// older than maxAge (when maxAge > 0), and eagerly rewrites the affected
+// leaf clusterIDs slices in the prefix tree instead of relying on
+// addSeqToPrefixTree's lazy cleanup. It returns the number of clusters
+// removed. Config.OnEvict, if set, is called for each cluster Prune
+// removes, the same as it would be for an LRU-driven eviction.
+func (d *Drain) Prune(minSize int, maxAge time.Duration) int {
+	now := time.Now()
+	removed := make(map[int]struct{})
+	for _, cluster := range d.idToCluster.Values() {
+		if cluster.size < minSize || (maxAge > 0 && now.Sub(cluster.lastSeen) > maxAge) {
+			removed[cluster.id] = struct{}{}
+		}
+	}
+	if len(removed) == 0 {
+		return 0
+	}
+	for id := range removed {
+		d.idToCluster.Remove(id)
+	}
+	d.pruneNode(d.rootNode, removed)
+	return len(removed)
+}
+
+func (d *Drain) pruneNode(node *Node, removed map[int]struct{}) {
+	if len(node.clusterIDs) > 0 {
+		keptClusterIDs := make([]int, 0, len(node.clusterIDs))
+		for _, clusterID := range node.clusterIDs {
+			if _, ok := removed[clusterID]; !ok {
+				keptClusterIDs = append(keptClusterIDs, clusterID)
+			}
+		}
+		node.clusterIDs = keptClusterIDs
+	}
+	for _, child := range node.keyToChildNode {
+		d.pruneNode(child, removed)
+	}
+}
+
 func (d *Drain) getParamString(token string) string {
 	for paramPattern, paramPatternRegexp := range d.config.ParamPatterns {
 		if paramPatternRegexp.MatchString(token) {
@@ -196,7 +423,7 @@ func (d *Drain) getParamString(token string) string {
 	return ""
 }
 
-func (d *Drain) treeSearch(rootNode *Node, tokens []string, simTh float64, includeParams bool) *Cluster {
+func (d *Drain) treeSearch(rootNode *Node, tokens []string, simTh float64, includeParams bool) (*Cluster, int) {
 	tokenCount := len(tokens)
 
 	// at first level, children are grouped by token (word) count
@@ -204,12 +431,12 @@ func (d *Drain) treeSearch(rootNode *Node, tokens []string, simTh float64, inclu
 
 	// no template with same token count yet
 	if !ok {
-		return nil
+		return nil, 0
 	}
 
 	// handle case of empty string - return the single cluster in that group
 	if tokenCount == 0 {
-		return d.idToCluster.Get(curNode.clusterIDs[0])
+		return d.idToCluster.Get(curNode.clusterIDs[0]), 1
 	}
 
 	// find the leaf node for this - a path of nodes matching the first N tokens (N=tree depth)
@@ -231,14 +458,14 @@ func (d *Drain) treeSearch(rootNode *Node, tokens []string, simTh float64, inclu
 			curNode, ok = keyToChildNode[d.getParamString(token)]
 		}
 		if !ok { // no wildcard node exist
-			return nil
+			return nil, curNodeDepth
 		}
 		curNodeDepth++
 	}
 
 	// get best match among all clusters with same prefix, or None if no match is above sim_th
 	cluster := d.fastMatch(curNode.clusterIDs, tokens, simTh, includeParams)
-	return cluster
+	return cluster, curNodeDepth
 }
 
 // fastMatch Find the best match for a message (represented as tokens) versus a list of clusters
@@ -291,7 +518,7 @@ func (d *Drain) getSeqDistance(seq1, seq2 []string, includeParams bool) (float64
 	return retVal, paramCount
 }
 
-func (d *Drain) addSeqToPrefixTree(rootNode *Node, cluster *Cluster) {
+func (d *Drain) addSeqToPrefixTree(rootNode *Node, cluster *Cluster) (depth int, wildcardBranch bool, stalePruned bool) {
 	tokenCount := len(cluster.tokens)
 	tokenCountStr := strconv.Itoa(tokenCount)
 
@@ -305,7 +532,7 @@ func (d *Drain) addSeqToPrefixTree(rootNode *Node, cluster *Cluster) {
 	// handle case of empty string
 	if tokenCount == 0 {
 		curNode.clusterIDs = append(curNode.clusterIDs, cluster.id)
-		return
+		return 1, false, false
 	}
 
 	currentDepth := 1
@@ -319,6 +546,9 @@ func (d *Drain) addSeqToPrefixTree(rootNode *Node, cluster *Cluster) {
 					newClusterIDs = append(newClusterIDs, clusterID)
 				}
 			}
+			if len(newClusterIDs) != len(curNode.clusterIDs) {
+				stalePruned = true
+			}
 			newClusterIDs = append(newClusterIDs, cluster.id)
 			curNode.clusterIDs = newClusterIDs
 			break
@@ -336,6 +566,7 @@ func (d *Drain) addSeqToPrefixTree(rootNode *Node, cluster *Cluster) {
 						curNode = newNode
 					} else {
 						curNode = curNode.keyToChildNode[paramString]
+						wildcardBranch = true
 					}
 				} else {
 					if len(curNode.keyToChildNode)+1 < d.config.MaxChildren {
@@ -346,8 +577,10 @@ func (d *Drain) addSeqToPrefixTree(rootNode *Node, cluster *Cluster) {
 						newNode := createNode()
 						curNode.keyToChildNode[paramString] = newNode
 						curNode = newNode
+						wildcardBranch = true
 					} else {
 						curNode = curNode.keyToChildNode[paramString]
+						wildcardBranch = true
 					}
 				}
 			} else {
@@ -366,6 +599,7 @@ func (d *Drain) addSeqToPrefixTree(rootNode *Node, cluster *Cluster) {
 
 		currentDepth++
 	}
+	return currentDepth, wildcardBranch, stalePruned
 }
 
 func (d *Drain) hasNumbers(s string) bool {
@@ -390,3 +624,117 @@ func (d *Drain) createTemplate(source, target []string) []string {
 	}
 	return retVal
 }
+
+// snapshotHeader identifies the schema Version a snapshot was written with,
+// plus the counters needed to resume cluster ID allocation after a restore.
+type snapshotHeader struct {
+	Version         int
+	ClustersCounter int
+}
+
+// snapshotCluster is the serializable form of a Cluster. The join func
+// itself is not persisted; FromTokens records which Config field it should
+// be rebuilt from (LineTokenizer.Join vs Joiner) when loading.
+type snapshotCluster struct {
+	ID         int
+	Tokens     []string
+	Size       int
+	FromTokens bool
+	LastSeen   time.Time
+}
+
+// snapshotNode is the serializable form of a Node.
+type snapshotNode struct {
+	Children   map[string]*snapshotNode
+	ClusterIDs []int
+}
+
+// snapshotData is the full on-disk representation written by Snapshot.
+type snapshotData struct {
+	Header   snapshotHeader
+	Clusters []snapshotCluster
+	Root     *snapshotNode
+}
+
+func newSnapshotNode(node *Node) *snapshotNode {
+	sn := &snapshotNode{
+		Children:   make(map[string]*snapshotNode, len(node.keyToChildNode)),
+		ClusterIDs: node.clusterIDs,
+	}
+	for key, child := range node.keyToChildNode {
+		sn.Children[key] = newSnapshotNode(child)
+	}
+	return sn
+}
+
+func (sn *snapshotNode) toNode() *Node {
+	node := &Node{
+		keyToChildNode: make(map[string]*Node, len(sn.Children)),
+		clusterIDs:     sn.ClusterIDs,
+	}
+	for key, child := range sn.Children {
+		node.keyToChildNode[key] = child.toNode()
+	}
+	return node
+}
+
+// Snapshot serializes the prefix tree, the cluster cache, and the cluster
+// ID counter into a versioned binary format, so a long-running service can
+// persist learned templates across restarts without retraining.
+func (d *Drain) Snapshot(w io.Writer) error {
+	data := &snapshotData{
+		Header: snapshotHeader{
+			Version:         d.config.Version,
+			ClustersCounter: d.clustersCounter,
+		},
+		Root: newSnapshotNode(d.rootNode),
+	}
+	for _, cluster := range d.idToCluster.Values() {
+		data.Clusters = append(data.Clusters, snapshotCluster{
+			ID:         cluster.id,
+			Tokens:     cluster.tokens,
+			Size:       cluster.size,
+			FromTokens: cluster.fromTokens,
+			LastSeen:   cluster.lastSeen,
+		})
+	}
+	if err := gob.NewEncoder(w).Encode(data); err != nil {
+		return fmt.Errorf("drain: encode snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadSnapshot restores a Drain instance previously serialized with
+// Snapshot. config is used exactly as it would be for New, including
+// Config.Version: a snapshot written under a different Version is rejected
+// rather than silently loaded.
+func LoadSnapshot(r io.Reader, config *Config) (*Drain, error) {
+	var data snapshotData
+	if err := gob.NewDecoder(r).Decode(&data); err != nil {
+		return nil, fmt.Errorf("drain: decode snapshot: %w", err)
+	}
+	if data.Header.Version != config.Version {
+		return nil, fmt.Errorf("drain: snapshot version %d is incompatible with config version %d", data.Header.Version, config.Version)
+	}
+
+	d := New(config)
+	d.clustersCounter = data.Header.ClustersCounter
+	for _, sc := range data.Clusters {
+		join := d.config.LineTokenizer.Join
+		if sc.FromTokens {
+			join = d.config.Joiner
+		}
+		d.idToCluster.Set(sc.ID, &Cluster{
+			id:         sc.ID,
+			tokens:     sc.Tokens,
+			size:       sc.Size,
+			join:       join,
+			fromTokens: sc.FromTokens,
+			lastSeen:   sc.LastSeen,
+		})
+	}
+	if data.Root != nil {
+		d.rootNode = data.Root.toNode()
+	}
+	return d, nil
+}
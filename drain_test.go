@@ -0,0 +1,76 @@
+package drain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newSnapshotTestConfig() *Config {
+	return NewConfig(SpaceTokenizer, map[string]string{
+		"{ip}":   `^([0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3})$`,
+		"{name}": `^\w+$`,
+	})
+}
+
+// TestSnapshotRoundTrip trains a Drain instance, snapshots it, restores the
+// snapshot into a fresh instance with the same Config, and checks that
+// Match returns identical clusters for held-out lines on both instances.
+func TestSnapshotRoundTrip(t *testing.T) {
+	trainLines := []string{
+		"connected to host 10.0.0.1",
+		"connected to host 10.0.0.2",
+		"connected to host 10.0.0.3",
+		"user davidoh logged in today",
+		"user eranr logged in today",
+	}
+
+	original := New(newSnapshotTestConfig())
+	for _, line := range trainLines {
+		original.Train(line)
+	}
+
+	var buf bytes.Buffer
+	if err := original.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+
+	restored, err := LoadSnapshot(&buf, newSnapshotTestConfig())
+	if err != nil {
+		t.Fatalf("LoadSnapshot() error = %v", err)
+	}
+
+	heldOutLines := []string{
+		"connected to host 10.0.0.4",
+		"user faceair logged in today",
+	}
+	for _, line := range heldOutLines {
+		want := original.Match(line)
+		got := restored.Match(line)
+		if want == nil || got == nil {
+			t.Fatalf("Match(%q) = %v, restored Match(%q) = %v; want both non-nil", line, want, line, got)
+		}
+		if want.id != got.id || want.String() != got.String() {
+			t.Errorf("Match(%q) mismatch: original = %s, restored = %s", line, want, got)
+		}
+	}
+}
+
+// TestLoadSnapshotRejectsVersionMismatch checks that LoadSnapshot refuses a
+// snapshot written under a different Config.Version.
+func TestLoadSnapshotRejectsVersionMismatch(t *testing.T) {
+	config := newSnapshotTestConfig()
+	config.Version = 1
+	original := New(config)
+	original.Train("connected to host 10.0.0.1")
+
+	var buf bytes.Buffer
+	if err := original.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+
+	incompatible := newSnapshotTestConfig()
+	incompatible.Version = 2
+	if _, err := LoadSnapshot(&buf, incompatible); err == nil {
+		t.Fatal("LoadSnapshot() error = nil, want a version mismatch error")
+	}
+}
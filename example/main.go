@@ -14,11 +14,11 @@ func main() {
 	}))
 
 	for _, line := range []string{
-		"connected to 10.0.0.1",
-		"connected to 10.0.0.2",
-		"connected to 10.0.0.3",
-		"Hex number 0xDEADBEAF",
-		"Hex number 0x10000",
+		"connected to host 10.0.0.1",
+		"connected to host 10.0.0.2",
+		"connected to host 10.0.0.3",
+		"received hex number 0xDEADBEAF",
+		"received hex number 0x10000",
 		"user davidoh logged in",
 		"user eranr logged in",
 	} {